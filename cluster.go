@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// scrapeTarget is one (shard, database) pair to pull system.profile from.
+// shard is "" for a standalone instance or non-sharded replica set, where
+// every database is reachable through the main connection.
+type scrapeTarget struct {
+	shard    string
+	database string
+	uri      string
+}
+
+func (t scrapeTarget) label() string {
+	if t.shard == "" {
+		return t.database
+	}
+	return fmt.Sprintf("%s/%s", t.shard, t.database)
+}
+
+// targetResult accumulates a single target's scrape before it is merged
+// into the shared clusterResult, so the decode loop never has to take a
+// lock.
+type targetResult struct {
+	count       int64
+	totalTimeMs float64
+	latency     *tDigest
+	total       *opBucket
+	byOp        map[string]*opBucket
+	byNs        map[string]*opBucket
+	byPlan      map[string]*opBucket
+}
+
+func newTargetResult() *targetResult {
+	return &targetResult{
+		latency: newTDigest(),
+		total:   &opBucket{},
+		byOp:    map[string]*opBucket{},
+		byNs:    map[string]*opBucket{},
+		byPlan:  map[string]*opBucket{},
+	}
+}
+
+// clusterResult is the lock-protected aggregate of every scrapeTarget's
+// results.
+type clusterResult struct {
+	mu sync.Mutex
+
+	count        int64
+	totalTimeMs  float64
+	latency      *tDigest
+	byOp         map[string]*opBucket
+	byNs         map[string]*opBucket
+	byPlan       map[string]*opBucket
+	byDatabase   map[string]*opBucket
+	byShard      map[string]*opBucket
+	scrapeErrors int64
+}
+
+func newClusterResult() *clusterResult {
+	return &clusterResult{
+		latency:    newTDigest(),
+		byOp:       map[string]*opBucket{},
+		byNs:       map[string]*opBucket{},
+		byPlan:     map[string]*opBucket{},
+		byDatabase: map[string]*opBucket{},
+		byShard:    map[string]*opBucket{},
+	}
+}
+
+func (r *clusterResult) merge(target scrapeTarget, local *targetResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count += local.count
+	r.totalTimeMs += local.totalTimeMs
+	r.latency.Merge(local.latency)
+	mergeBuckets(r.byOp, local.byOp)
+	mergeBuckets(r.byNs, local.byNs)
+	mergeBuckets(r.byPlan, local.byPlan)
+
+	bucketFor(r.byDatabase, target.database).addBucket(local.total)
+	if target.shard != "" {
+		bucketFor(r.byShard, target.shard).addBucket(local.total)
+	}
+}
+
+func (r *clusterResult) recordError() {
+	r.mu.Lock()
+	r.scrapeErrors++
+	r.mu.Unlock()
+}
+
+func mergeBuckets(dst, src map[string]*opBucket) {
+	for key, b := range src {
+		bucketFor(dst, key).addBucket(b)
+	}
+}
+
+// resolveDatabases returns the databases to scrape: every non-internal
+// database when -all-databases is set, the -databases list when given, or
+// the single -database otherwise.
+func (m MongoDBSlowQueriesPlugin) resolveDatabases(ctx context.Context, client *mongo.Client) ([]string, error) {
+	if m.AllDatabases {
+		names, err := client.ListDatabaseNames(ctx, bson.M{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list databases: %v", err)
+		}
+		dbs := make([]string, 0, len(names))
+		for _, name := range names {
+			switch name {
+			case "admin", "local", "config":
+				continue
+			}
+			dbs = append(dbs, name)
+		}
+		return dbs, nil
+	}
+	if len(m.Databases) > 0 {
+		return m.Databases, nil
+	}
+	return []string{m.Database}, nil
+}
+
+// shard is a single member of a sharded cluster, discovered via
+// config.shards.
+type shard struct {
+	name string
+	uri  string
+}
+
+// discoverShards detects whether we're talking to a mongos (the deployment
+// is sharded) and, if so, returns one entry per shard with a URI pointed
+// directly at that shard's replica set: system.profile lives on each mongod
+// and isn't visible through mongos. Returns a nil slice for a standalone or
+// non-sharded replica-set deployment.
+func (m MongoDBSlowQueriesPlugin) discoverShards(ctx context.Context, client *mongo.Client, baseURI string) ([]shard, error) {
+	var isMaster bson.M
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&isMaster); err != nil {
+		return nil, fmt.Errorf("failed to run isMaster: %v", err)
+	}
+	if msg, _ := isMaster["msg"].(string); msg != "isdbgrid" {
+		return nil, nil
+	}
+
+	base, err := url.Parse(baseURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse base URI: %v", err)
+	}
+
+	cursor, err := client.Database("config").Collection("shards").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list config.shards: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var shards []shard
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		name, _ := doc["_id"].(string)
+		host, _ := doc["host"].(string)
+		if host == "" {
+			continue
+		}
+		// host is "shardReplSetName/host1:port1,host2:port2,..." for a
+		// replica-set shard, or a bare "host:port" for a standalone one.
+		var replicaSet, members string
+		if idx := strings.Index(host, "/"); idx >= 0 {
+			replicaSet, members = host[:idx], host[idx+1:]
+		} else {
+			members = host
+		}
+		shards = append(shards, shard{name: name, uri: shardTargetURI(*base, members, replicaSet)})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %v", err)
+	}
+	return shards, nil
+}
+
+// shardTargetURI rewrites base into a URI pointed at one shard's replica-set
+// members. mongodb+srv:// requires exactly one host and no explicit ports,
+// which a comma-separated member list violates, so an SRV base is always
+// downgraded to mongodb:// for shard targets; replicaSet stands in for the
+// DNS-discovered replica set name mongodb+srv would otherwise have
+// supplied. Any TLS/auth query parameters already on base carry over
+// unchanged since they're preserved by copying base rather than rebuilding
+// the URI from scratch.
+func shardTargetURI(base url.URL, members, replicaSet string) string {
+	base.Host = members
+	if base.Scheme == "mongodb+srv" {
+		base.Scheme = "mongodb"
+	}
+	if replicaSet != "" {
+		q := base.Query()
+		if q.Get("replicaSet") == "" {
+			q.Set("replicaSet", replicaSet)
+			base.RawQuery = q.Encode()
+		}
+	}
+	return base.String()
+}
+
+// scrapeAll runs every target's scrape through a bounded worker pool (sized
+// by -max-parallel) and merges the results into agg. A target that fails
+// (e.g. an unreachable shard) only increments scrape_errors; it never fails
+// the whole run.
+func (m MongoDBSlowQueriesPlugin) scrapeAll(ctx context.Context, targets []scrapeTarget, agg *clusterResult) {
+	sem := make(chan struct{}, m.MaxParallel)
+	var wg sync.WaitGroup
+
+	for _, target := range targets {
+		target := target
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := m.scrapeTarget(ctx, target)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to scrape %s: %v\n", target.label(), err)
+				agg.recordError()
+				return
+			}
+			agg.merge(target, result)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// scrapeTarget connects to a single shard/database pair, optionally enforces
+// the profiler configuration on it, and collects its system.profile slow
+// queries into a fresh targetResult.
+func (m MongoDBSlowQueriesPlugin) scrapeTarget(ctx context.Context, target scrapeTarget) (*targetResult, error) {
+	// ctx only carries the aggregate deadline for the whole worker pool; bound
+	// this target to its own m.Timeout slice of it so one slow/hanging shard
+	// fails fast and frees its worker-pool slot instead of sitting on the
+	// shared deadline for (close to) the entire run.
+	targetCtx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(target.uri)
+	if m.URI == "" {
+		clientOptions.SetReadPreference(readpref.SecondaryPreferred())
+	}
+
+	client, err := mongo.Connect(targetCtx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer func() {
+		if err := client.Disconnect(targetCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to disconnect from %s: %v\n", target.label(), err)
+		}
+	}()
+
+	if err := client.Ping(targetCtx, nil); err != nil {
+		return nil, fmt.Errorf("failed to ping: %v", err)
+	}
+
+	return m.collectProfile(targetCtx, client, target)
+}
+
+// collectProfile optionally enforces the profiler configuration on target's
+// database and collects its system.profile slow queries into a fresh
+// targetResult, using an already-connected client. Split out of scrapeTarget
+// so FetchMetrics can reuse its own discovery connection for the common
+// single-database, non-sharded case instead of paying a second connect+ping.
+func (m MongoDBSlowQueriesPlugin) collectProfile(ctx context.Context, client *mongo.Client, target scrapeTarget) (*targetResult, error) {
+	if m.ManageProfiler {
+		if err := m.ensureProfiling(ctx, client, target.database); err != nil {
+			return nil, fmt.Errorf("failed to configure profiler: %v", err)
+		}
+	}
+
+	collection := client.Database(target.database).Collection("system.profile")
+
+	since := time.Now().Add(-m.Lookback)
+	filter := bson.M{"ts": bson.M{"$gt": since}}
+	if m.ProfileFilter != "" {
+		extra, err := parseProfileFilter(m.ProfileFilter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -profile-filter: %v", err)
+		}
+		for k, v := range extra {
+			filter[k] = v
+		}
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find documents: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	result := newTargetResult()
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+
+		result.count++
+		if millis, ok := toFloat64(doc["millis"]); ok {
+			result.totalTimeMs += millis
+			result.latency.Add(millis)
+		}
+
+		op, _ := doc["op"].(string)
+		ns, _ := doc["ns"].(string)
+		planSummary, _ := doc["planSummary"].(string)
+
+		bucketFor(result.byOp, op).add(doc)
+		bucketFor(result.byNs, ns).add(doc)
+		bucketFor(result.byPlan, planSummary).add(doc)
+		result.total.add(doc)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %v", err)
+	}
+
+	return result, nil
+}
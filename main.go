@@ -4,7 +4,9 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
@@ -17,11 +19,36 @@ import (
 // MongoDBSlowQueriesPlugin mackerel plugin for mongo
 type MongoDBSlowQueriesPlugin struct {
 	Prefix   string
+	URI      string
 	Host     string
 	Port     string
 	Username string
 	Password string
 	Database string
+
+	Lookback          time.Duration
+	ProfileFilter     string
+	ManageProfiler    bool
+	ProfileLevel      int
+	SlowMs            int64
+	ProfileSampleRate float64
+
+	AllDatabases bool
+	Databases    []string
+	MaxParallel  int
+	Timeout      time.Duration
+}
+
+// scrapeTimeout returns the deadline for the scrape phase: one -timeout
+// budget per sequential batch the bounded worker pool has to run, since a
+// single -timeout (sized for one connect+query) would starve any fan-out
+// across more than -max-parallel targets.
+func (m MongoDBSlowQueriesPlugin) scrapeTimeout(numTargets int) time.Duration {
+	if numTargets == 0 {
+		return m.Timeout
+	}
+	batches := (numTargets + m.MaxParallel - 1) / m.MaxParallel
+	return time.Duration(batches) * m.Timeout
 }
 
 func (m MongoDBSlowQueriesPlugin) MetricKeyPrefix() string {
@@ -41,124 +68,389 @@ func (m MongoDBSlowQueriesPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "count", Label: "Slow Queries"},
 				{Name: "total_time", Label: "Total Time (ms)"},
 				{Name: "average_time", Label: "Average Time (ms)"},
+				{Name: "scrape_errors", Label: "Scrape Errors"},
+			},
+		},
+		"slow_queries_op.#": {
+			Label: "MongoDB Slow Queries by Operation",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#.count", Label: "%1 Count"},
+				{Name: "#.total_time", Label: "%1 Total Time (ms)"},
+				{Name: "#.docs_examined", Label: "%1 Docs Examined"},
+				{Name: "#.keys_examined", Label: "%1 Keys Examined"},
+				{Name: "#.nreturned", Label: "%1 Returned"},
+			},
+		},
+		"slow_queries_ns.#": {
+			Label: "MongoDB Slow Queries by Namespace",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#.count", Label: "%1 Count"},
+				{Name: "#.total_time", Label: "%1 Total Time (ms)"},
+				{Name: "#.docs_examined", Label: "%1 Docs Examined"},
+				{Name: "#.keys_examined", Label: "%1 Keys Examined"},
+				{Name: "#.nreturned", Label: "%1 Returned"},
+			},
+		},
+		"slow_query_latency": {
+			Label: "MongoDB Slow Query Latency",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "p50", Label: "p50 (ms)"},
+				{Name: "p95", Label: "p95 (ms)"},
+				{Name: "p99", Label: "p99 (ms)"},
+				{Name: "max", Label: "Max (ms)"},
+			},
+		},
+		"slow_queries_plan.#": {
+			Label: "MongoDB Slow Queries by Plan Summary",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#.count", Label: "%1 Count"},
+				{Name: "#.total_time", Label: "%1 Total Time (ms)"},
+				{Name: "#.docs_examined", Label: "%1 Docs Examined"},
+				{Name: "#.keys_examined", Label: "%1 Keys Examined"},
+				{Name: "#.nreturned", Label: "%1 Returned"},
+			},
+		},
+		"slow_queries_db.#": {
+			Label: "MongoDB Slow Queries by Database",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#.count", Label: "%1 Count"},
+				{Name: "#.total_time", Label: "%1 Total Time (ms)"},
+				{Name: "#.docs_examined", Label: "%1 Docs Examined"},
+				{Name: "#.keys_examined", Label: "%1 Keys Examined"},
+				{Name: "#.nreturned", Label: "%1 Returned"},
 			},
 		},
+		"slow_queries_shard.#": {
+			Label: "MongoDB Slow Queries by Shard",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#.count", Label: "%1 Count"},
+				{Name: "#.total_time", Label: "%1 Total Time (ms)"},
+				{Name: "#.docs_examined", Label: "%1 Docs Examined"},
+				{Name: "#.keys_examined", Label: "%1 Keys Examined"},
+				{Name: "#.nreturned", Label: "%1 Returned"},
+			},
+		},
+	}
+}
+
+// opBucket accumulates slow-query totals for one breakdown key (an op type,
+// a namespace, or a planSummary value).
+type opBucket struct {
+	count        int64
+	totalTimeMs  float64
+	docsExamined float64
+	keysExamined float64
+	nreturned    float64
+}
+
+func (b *opBucket) add(result bson.M) {
+	b.count++
+	if millis, ok := toFloat64(result["millis"]); ok {
+		b.totalTimeMs += millis
+	}
+	if v, ok := toFloat64(result["docsExamined"]); ok {
+		b.docsExamined += v
+	}
+	if v, ok := toFloat64(result["keysExamined"]); ok {
+		b.keysExamined += v
+	}
+	if v, ok := toFloat64(result["nreturned"]); ok {
+		b.nreturned += v
 	}
 }
 
+func (b *opBucket) addBucket(o *opBucket) {
+	b.count += o.count
+	b.totalTimeMs += o.totalTimeMs
+	b.docsExamined += o.docsExamined
+	b.keysExamined += o.keysExamined
+	b.nreturned += o.nreturned
+}
+
+func (b *opBucket) addTo(metrics map[string]float64, graph, key string) {
+	metrics[fmt.Sprintf("%s.%s.count", graph, key)] = float64(b.count)
+	metrics[fmt.Sprintf("%s.%s.total_time", graph, key)] = b.totalTimeMs
+	metrics[fmt.Sprintf("%s.%s.docs_examined", graph, key)] = b.docsExamined
+	metrics[fmt.Sprintf("%s.%s.keys_examined", graph, key)] = b.keysExamined
+	metrics[fmt.Sprintf("%s.%s.nreturned", graph, key)] = b.nreturned
+}
+
+// toFloat64 converts the numeric BSON types system.profile fields commonly
+// decode to (int32/int64/float64) into a float64.
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// sanitizeMetricKey makes a value from a profile document (an op name, a
+// "db.collection" namespace, or a planSummary) safe to embed as a mackerel
+// dynamic graph key segment: '.' is mackerel-plugin's own key separator, so
+// namespaces (which always contain one) would otherwise be split into the
+// wrong number of segments.
+func sanitizeMetricKey(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	replacer := strings.NewReplacer(".", "_", " ", "_")
+	return replacer.Replace(s)
+}
+
+// buildURI assembles the MongoDB connection URI. If m.URI was set (via -uri or
+// MONGODB_URI), it is used as-is so callers keep full control over TLS,
+// authSource/authMechanism, replica set and SRV discovery options. Otherwise a
+// URI is composed from the discrete -host/-port/-username/-password flags,
+// with the credentials URL-escaped since passwords sourced from env vars
+// commonly contain reserved characters such as '@', ':', '/' or '?'.
+func (m MongoDBSlowQueriesPlugin) buildURI() string {
+	if m.URI != "" {
+		return m.URI
+	}
+	if m.Username != "" && m.Password != "" {
+		userinfo := url.UserPassword(m.Username, m.Password).String()
+		return fmt.Sprintf("mongodb://%s@%s:%s/%s?authSource=admin",
+			userinfo, m.Host, m.Port, m.Database)
+	}
+	return fmt.Sprintf("mongodb://%s:%s/%s",
+		m.Host, m.Port, m.Database)
+}
+
+// validateMongoURI rejects URIs that are obviously malformed before we ever
+// try to dial MongoDB, so mistakes in -uri/MONGODB_URI fail fast with a
+// readable error instead of an opaque connection timeout.
+func validateMongoURI(uri string) error {
+	if !strings.HasPrefix(uri, "mongodb://") && !strings.HasPrefix(uri, "mongodb+srv://") {
+		return fmt.Errorf("uri must start with mongodb:// or mongodb+srv://")
+	}
+	return options.Client().ApplyURI(uri).Validate()
+}
+
 // FetchMetrics interface for mackerelplugin
 func (m MongoDBSlowQueriesPlugin) FetchMetrics() (map[string]float64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	connectCtx, cancel := context.WithTimeout(context.Background(), m.Timeout)
 	defer cancel()
 
-	// Build MongoDB connection URI
-	var uri string
-	if m.Username != "" && m.Password != "" {
-		uri = fmt.Sprintf("mongodb://%s:%s@%s:%s/%s?authSource=admin",
-			m.Username, m.Password, m.Host, m.Port, m.Database)
-	} else {
-		uri = fmt.Sprintf("mongodb://%s:%s/%s",
-			m.Host, m.Port, m.Database)
-	}
+	uri := m.buildURI()
 
 	// Set connection options
 	clientOptions := options.Client().ApplyURI(uri)
-	// Read from secondary if available, otherwise from primary
-	clientOptions.SetReadPreference(readpref.SecondaryPreferred())
+	if m.URI == "" {
+		// Read from secondary if available, otherwise from primary.
+		// When a full URI is supplied the caller owns the read preference
+		// (and any TLS/authMechanism options) via the URI itself.
+		clientOptions.SetReadPreference(readpref.SecondaryPreferred())
+	}
 
 	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, clientOptions)
+	client, err := mongo.Connect(connectCtx, clientOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
 	}
 	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
+		disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), m.Timeout)
+		defer disconnectCancel()
+		if err := client.Disconnect(disconnectCtx); err != nil {
 			fmt.Fprintf(os.Stderr, "failed to disconnect from MongoDB: %v\n", err)
 		}
 	}()
 
 	// Verify connection
-	if err := client.Ping(ctx, nil); err != nil {
+	if err := client.Ping(connectCtx, nil); err != nil {
 		return nil, fmt.Errorf("failed to ping MongoDB: %v", err)
 	}
 
-	// Access system.profile collection
-	collection := client.Database(m.Database).Collection("system.profile")
-
-	// Get timestamp from 1 minute ago
-	oneMinuteAgo := time.Now().Add(-1 * time.Minute)
-
-	// Retrieve slow queries
-	filter := bson.M{"ts": bson.M{"$gt": oneMinuteAgo}}
-	cursor, err := collection.Find(ctx, filter)
+	dbNames, err := m.resolveDatabases(connectCtx, client)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find documents: %v", err)
+		return nil, fmt.Errorf("failed to resolve target databases: %v", err)
 	}
-	defer cursor.Close(ctx)
 
-	// Calculate metrics
-	var count int64
-	var totalTimeMs float64
+	shards, err := m.discoverShards(connectCtx, client, uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover shards: %v", err)
+	}
 
-	for cursor.Next(ctx) {
-		var result bson.M
-		if err := cursor.Decode(&result); err != nil {
-			continue
+	var targets []scrapeTarget
+	if len(shards) == 0 {
+		for _, db := range dbNames {
+			targets = append(targets, scrapeTarget{database: db, uri: uri})
 		}
-		
-		count++
-		
-		// Get execution time from millis field
-		if millis, ok := result["millis"].(int32); ok {
-			totalTimeMs += float64(millis)
-		} else if millis, ok := result["millis"].(int64); ok {
-			totalTimeMs += float64(millis)
-		} else if millis, ok := result["millis"].(float64); ok {
-			totalTimeMs += millis
+	} else {
+		for _, sh := range shards {
+			for _, db := range dbNames {
+				targets = append(targets, scrapeTarget{shard: sh.name, database: db, uri: sh.uri})
+			}
 		}
 	}
 
-	if err := cursor.Err(); err != nil {
-		return nil, fmt.Errorf("cursor error: %v", err)
+	agg := newClusterResult()
+	if len(shards) == 0 && len(targets) == 1 {
+		// The common case: a single non-sharded database. Reuse the
+		// connection already established above instead of paying a second
+		// connect+TLS+auth round trip just to scrape the one target.
+		target := targets[0]
+		result, err := m.collectProfile(connectCtx, client, target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to scrape %s: %v\n", target.label(), err)
+			agg.recordError()
+		} else {
+			agg.merge(target, result)
+		}
+	} else {
+		// The bounded worker pool runs len(targets)/-max-parallel sequential
+		// batches, each paying its own connect+query against m.Timeout, so the
+		// scrape phase needs a timeout that scales with the batch count instead
+		// of the single-query constant used for the initial connection above.
+		scrapeCtx, scrapeCancel := context.WithTimeout(context.Background(), m.scrapeTimeout(len(targets)))
+		defer scrapeCancel()
+		m.scrapeAll(scrapeCtx, targets, agg)
 	}
 
 	// Calculate average time
 	var averageTimeMs float64
-	if count > 0 {
-		averageTimeMs = totalTimeMs / float64(count)
+	if agg.count > 0 {
+		averageTimeMs = agg.totalTimeMs / float64(agg.count)
+	}
+
+	metrics := map[string]float64{
+		"count":         float64(agg.count),
+		"total_time":    agg.totalTimeMs,
+		"average_time":  averageTimeMs,
+		"p50":           agg.latency.Quantile(0.5),
+		"p95":           agg.latency.Quantile(0.95),
+		"p99":           agg.latency.Quantile(0.99),
+		"max":           agg.latency.Max(),
+		"scrape_errors": float64(agg.scrapeErrors),
 	}
 
-	return map[string]float64{
-		"count":        float64(count),
-		"total_time":   totalTimeMs,
-		"average_time": averageTimeMs,
-	}, nil
+	for key, b := range agg.byOp {
+		b.addTo(metrics, "slow_queries_op", key)
+	}
+	for key, b := range agg.byNs {
+		b.addTo(metrics, "slow_queries_ns", key)
+	}
+	for key, b := range agg.byPlan {
+		b.addTo(metrics, "slow_queries_plan", key)
+	}
+	for key, b := range agg.byDatabase {
+		b.addTo(metrics, "slow_queries_db", key)
+	}
+	for key, b := range agg.byShard {
+		b.addTo(metrics, "slow_queries_shard", key)
+	}
+
+	return metrics, nil
+}
+
+// bucketFor returns the bucket for the sanitized key, creating it on first use.
+func bucketFor(buckets map[string]*opBucket, rawKey string) *opBucket {
+	key := sanitizeMetricKey(rawKey)
+	b, ok := buckets[key]
+	if !ok {
+		b = &opBucket{}
+		buckets[key] = b
+	}
+	return b
 }
 
 // Do the plugin
 func main() {
 	optPrefix := flag.String("metric-key-prefix", "mongodb", "Metric key prefix")
+	optURI := flag.String("uri", os.Getenv("MONGODB_URI"), "MongoDB connection URI (mongodb:// or mongodb+srv://), mutually exclusive with -host/-port")
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "27017", "Port")
 	optUser := flag.String("username", "", "Username")
 	optPass := flag.String("password", os.Getenv("MONGODB_PASSWORD"), "Password")
 	optDatabase := flag.String("database", "", "Database name")
+	optLookback := flag.Duration("lookback", time.Minute, "How far back to look in system.profile for slow queries")
+	optProfileFilter := flag.String("profile-filter", "", `Additional JSON filter merged into the system.profile query, e.g. {"op":{"$ne":"getmore"}}`)
+	optManageProfiler := flag.Bool("manage-profiler", false, "Issue the profile admin command before each run to ensure the database is profiling at -profile-level/-slow-ms/-profile-sample-rate")
+	optProfileLevel := flag.Int("profile-level", 1, "Profiling level to enforce when -manage-profiler is set (0, 1, or 2)")
+	optSlowMs := flag.Int64("slow-ms", 100, "slowms threshold to enforce when -manage-profiler is set")
+	optProfileSampleRate := flag.Float64("profile-sample-rate", 1.0, "sampleRate to enforce when -manage-profiler is set")
+	optAllDatabases := flag.Bool("all-databases", false, "Scrape system.profile across every database (excluding admin/local/config), fanning out across shards if the deployment is sharded")
+	optDatabasesList := flag.String("databases", "", "Comma-separated list of databases to scrape instead of -database")
+	optMaxParallel := flag.Int("max-parallel", 4, "Maximum number of database/shard scrapes to run concurrently")
+	optTimeout := flag.Duration("timeout", 10*time.Second, "Per-batch connect+query timeout budget; the overall scrape deadline scales with the number of databases/shards divided by -max-parallel")
 	flag.Parse()
 
-	if *optDatabase == "" {
-		fmt.Fprintln(os.Stderr, "Database name is required")
+	hostPortSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "host" || f.Name == "port" {
+			hostPortSet = true
+		}
+	})
+
+	if *optURI != "" {
+		if hostPortSet {
+			fmt.Fprintln(os.Stderr, "-uri is mutually exclusive with -host/-port")
+			os.Exit(1)
+		}
+		if err := validateMongoURI(*optURI); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid MongoDB URI: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *optDatabase == "" && !*optAllDatabases && *optDatabasesList == "" {
+		fmt.Fprintln(os.Stderr, "Database name is required (set -database, -databases, or -all-databases)")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if *optProfileLevel < 0 || *optProfileLevel > 2 {
+		fmt.Fprintln(os.Stderr, "-profile-level must be 0, 1, or 2")
+		os.Exit(1)
+	}
+
+	if *optMaxParallel < 1 {
+		fmt.Fprintln(os.Stderr, "-max-parallel must be at least 1")
+		os.Exit(1)
+	}
+
+	if *optTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "-timeout must be greater than 0")
+		os.Exit(1)
+	}
+
+	var databases []string
+	for _, d := range strings.Split(*optDatabasesList, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			databases = append(databases, d)
+		}
+	}
+
 	var mongodb MongoDBSlowQueriesPlugin
 	mongodb.Prefix = *optPrefix
+	mongodb.URI = *optURI
 	mongodb.Host = *optHost
 	mongodb.Port = *optPort
 	mongodb.Username = *optUser
 	mongodb.Password = *optPass
 	mongodb.Database = *optDatabase
+	mongodb.Lookback = *optLookback
+	mongodb.ProfileFilter = *optProfileFilter
+	mongodb.ManageProfiler = *optManageProfiler
+	mongodb.ProfileLevel = *optProfileLevel
+	mongodb.SlowMs = *optSlowMs
+	mongodb.ProfileSampleRate = *optProfileSampleRate
+	mongodb.AllDatabases = *optAllDatabases
+	mongodb.Databases = databases
+	mongodb.MaxParallel = *optMaxParallel
+	mongodb.Timeout = *optTimeout
 
 	helper := mp.NewMackerelPlugin(mongodb)
 	helper.Run()
-}
\ No newline at end of file
+}
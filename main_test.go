@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSanitizeMetricKey(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"", "unknown"},
+		{"query", "query"},
+		{"mydb.mycollection", "mydb_mycollection"},
+		{"mydb.my collection", "mydb_my_collection"},
+	}
+	for _, c := range cases {
+		if got := sanitizeMetricKey(c.in); got != c.want {
+			t.Errorf("sanitizeMetricKey(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestOpBucketAdd(t *testing.T) {
+	b := &opBucket{}
+	b.add(bson.M{"millis": int32(10), "docsExamined": int64(5), "keysExamined": int64(2), "nreturned": float64(1)})
+	b.add(bson.M{"millis": int32(20), "docsExamined": int64(15), "keysExamined": int64(8), "nreturned": float64(3)})
+
+	if b.count != 2 {
+		t.Errorf("count = %d, want 2", b.count)
+	}
+	if b.totalTimeMs != 30 {
+		t.Errorf("totalTimeMs = %v, want 30", b.totalTimeMs)
+	}
+	if b.docsExamined != 20 {
+		t.Errorf("docsExamined = %v, want 20", b.docsExamined)
+	}
+	if b.keysExamined != 10 {
+		t.Errorf("keysExamined = %v, want 10", b.keysExamined)
+	}
+	if b.nreturned != 4 {
+		t.Errorf("nreturned = %v, want 4", b.nreturned)
+	}
+}
+
+func TestOpBucketAddMissingFields(t *testing.T) {
+	b := &opBucket{}
+	b.add(bson.M{})
+	if b.count != 1 {
+		t.Errorf("count = %d, want 1", b.count)
+	}
+	if b.totalTimeMs != 0 || b.docsExamined != 0 || b.keysExamined != 0 || b.nreturned != 0 {
+		t.Errorf("expected all zero totals for a document with no numeric fields, got %+v", b)
+	}
+}
+
+func TestOpBucketAddBucket(t *testing.T) {
+	a := &opBucket{count: 1, totalTimeMs: 10, docsExamined: 2, keysExamined: 1, nreturned: 1}
+	b := &opBucket{count: 2, totalTimeMs: 20, docsExamined: 4, keysExamined: 3, nreturned: 2}
+
+	a.addBucket(b)
+
+	if a.count != 3 {
+		t.Errorf("count = %d, want 3", a.count)
+	}
+	if a.totalTimeMs != 30 {
+		t.Errorf("totalTimeMs = %v, want 30", a.totalTimeMs)
+	}
+	if a.docsExamined != 6 {
+		t.Errorf("docsExamined = %v, want 6", a.docsExamined)
+	}
+	if a.keysExamined != 4 {
+		t.Errorf("keysExamined = %v, want 4", a.keysExamined)
+	}
+	if a.nreturned != 3 {
+		t.Errorf("nreturned = %v, want 3", a.nreturned)
+	}
+}
+
+func TestBucketForMergeAcrossKeys(t *testing.T) {
+	dst := map[string]*opBucket{}
+	src := map[string]*opBucket{
+		"find":   {count: 3, totalTimeMs: 30},
+		"update": {count: 1, totalTimeMs: 5},
+	}
+
+	mergeBuckets(dst, src)
+	mergeBuckets(dst, map[string]*opBucket{"find": {count: 2, totalTimeMs: 10}})
+
+	if got := dst["find"].count; got != 5 {
+		t.Errorf("dst[find].count = %d, want 5", got)
+	}
+	if got := dst["find"].totalTimeMs; got != 40 {
+		t.Errorf("dst[find].totalTimeMs = %v, want 40", got)
+	}
+	if got := dst["update"].count; got != 1 {
+		t.Errorf("dst[update].count = %d, want 1", got)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ensureProfiling issues the `profile` admin command so the given database
+// is profiling at the configured level/threshold before we read its
+// system.profile. This is only called when -manage-profiler is set, so the
+// plugin can be pointed at a fresh instance where nobody has run
+// db.setProfilingLevel() yet. It is called once per scraped database, since
+// profiling is configured independently per database.
+func (m MongoDBSlowQueriesPlugin) ensureProfiling(ctx context.Context, client *mongo.Client, database string) error {
+	cmd := bson.D{
+		{Key: "profile", Value: m.ProfileLevel},
+		{Key: "slowms", Value: m.SlowMs},
+		{Key: "sampleRate", Value: m.ProfileSampleRate},
+	}
+	return client.Database(database).RunCommand(ctx, cmd).Err()
+}
+
+// parseProfileFilter decodes -profile-filter's JSON into a bson.M so it can
+// be merged into the system.profile query, e.g. {"op":{"$ne":"getmore"}}.
+func parseProfileFilter(raw string) (bson.M, error) {
+	var extra bson.M
+	if err := json.Unmarshal([]byte(raw), &extra); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+	return extra, nil
+}
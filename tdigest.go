@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// tdigestDelta controls the target compression accuracy: smaller values keep
+// more centroids (more accurate, more memory). tdigestCompressThreshold is
+// the centroid count above which each insertion re-merges adjacent
+// centroids. How many centroids survive a re-merge is set by the size bound,
+// not by this threshold, so the count can stay above it and grows slowly
+// (roughly logarithmically) with the number of samples added.
+const (
+	tdigestDelta             = 0.01
+	tdigestCompressThreshold = 100
+)
+
+// centroid is a single weighted mean in a t-digest.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tDigest is a streaming summary of a distribution of float64 samples,
+// following Dunning's t-digest: nearby samples are merged into weighted
+// centroids instead of being retained individually, so memory stays bounded
+// even if system.profile returns a large batch of slow queries in one tick.
+type tDigest struct {
+	centroids []centroid
+	count     float64
+}
+
+func newTDigest() *tDigest {
+	return &tDigest{}
+}
+
+// Add records a single observation, merging it into the nearest centroid
+// whose weight is still below its size bound, or inserting a new centroid
+// otherwise.
+func (t *tDigest) Add(value float64) {
+	t.addWeighted(value, 1)
+}
+
+// Merge folds another t-digest's centroids into this one, weighted as they
+// stand, so results gathered from independent shards/databases can be
+// combined without re-summing every raw millis value.
+func (t *tDigest) Merge(other *tDigest) {
+	for _, c := range other.centroids {
+		t.addWeighted(c.mean, c.weight)
+	}
+}
+
+func (t *tDigest) addWeighted(value, weight float64) {
+	t.count += weight
+
+	if len(t.centroids) == 0 {
+		t.centroids = append(t.centroids, centroid{mean: value, weight: weight})
+		return
+	}
+
+	idx := sort.Search(len(t.centroids), func(i int) bool {
+		return t.centroids[i].mean >= value
+	})
+
+	best := -1
+	bestDist := math.MaxFloat64
+	for _, i := range [2]int{idx - 1, idx} {
+		if i < 0 || i >= len(t.centroids) {
+			continue
+		}
+		if d := math.Abs(t.centroids[i].mean - value); d < bestDist {
+			bestDist = d
+			best = i
+		}
+	}
+
+	if best >= 0 && t.centroids[best].weight < t.sizeBound(best) {
+		c := &t.centroids[best]
+		c.mean += (value - c.mean) * weight / (c.weight + weight)
+		c.weight += weight
+		return
+	}
+
+	t.centroids = append(t.centroids, centroid{})
+	copy(t.centroids[idx+1:], t.centroids[idx:])
+	t.centroids[idx] = centroid{mean: value, weight: weight}
+
+	if len(t.centroids) > tdigestCompressThreshold {
+		t.compress()
+	}
+}
+
+// sizeBound returns the maximum weight centroid i may hold before it must
+// stop absorbing further points: 4*N*delta*q*(1-q), where N is the running
+// total weight and q is the centroid's quantile position within it. This
+// keeps centroids small (accurate) near the tails and large near the
+// median, which is where t-digest gets its tail-latency accuracy from.
+func (t *tDigest) sizeBound(i int) float64 {
+	cum := t.centroids[i].weight / 2
+	for j := 0; j < i; j++ {
+		cum += t.centroids[j].weight
+	}
+	q := cum / t.count
+	return 4 * t.count * tdigestDelta * q * (1 - q)
+}
+
+// compress does a single left-to-right pass merging each centroid into its
+// predecessor as long as the combined weight still fits the predecessor's
+// size bound, and starts a new centroid otherwise. This limits the centroid
+// count to what the size bound allows while preserving the small-near-the-tails/large-near-the-
+// median shape that gives t-digest its tail accuracy (a plain pairwise merge
+// would instead let whichever end keeps colliding run away in weight).
+func (t *tDigest) compress() {
+	merged := make([]centroid, 0, len(t.centroids)/2+1)
+	cum := 0.0
+	cur := t.centroids[0]
+
+	for i := 1; i < len(t.centroids); i++ {
+		next := t.centroids[i]
+		combined := cur.weight + next.weight
+		q := (cum + combined/2) / t.count
+		bound := 4 * t.count * tdigestDelta * q * (1 - q)
+		if combined <= bound {
+			cur = centroid{
+				mean:   (cur.mean*cur.weight + next.mean*next.weight) / combined,
+				weight: combined,
+			}
+			continue
+		}
+		merged = append(merged, cur)
+		cum += cur.weight
+		cur = next
+	}
+	merged = append(merged, cur)
+	t.centroids = merged
+}
+
+// Quantile estimates the value at quantile q (0..1) by walking centroids in
+// mean order, accumulating weight until it crosses q*N, and linearly
+// interpolating between the two straddling centroids' means.
+func (t *tDigest) Quantile(q float64) float64 {
+	switch len(t.centroids) {
+	case 0:
+		return 0
+	case 1:
+		return t.centroids[0].mean
+	}
+
+	target := q * t.count
+	var cum float64
+	for i, c := range t.centroids {
+		next := cum + c.weight
+		if next >= target || i == len(t.centroids)-1 {
+			if i == 0 {
+				return c.mean
+			}
+			prev := t.centroids[i-1]
+			if span := next - cum; span > 0 {
+				return prev.mean + (target-cum)/span*(c.mean-prev.mean)
+			}
+			return c.mean
+		}
+		cum = next
+	}
+	return t.centroids[len(t.centroids)-1].mean
+}
+
+// Max returns the largest observed value, or 0 if nothing was added.
+func (t *tDigest) Max() float64 {
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	return t.centroids[len(t.centroids)-1].mean
+}
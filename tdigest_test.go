@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTDigestQuantileUniform(t *testing.T) {
+	td := newTDigest()
+	for i := 1; i <= 1000; i++ {
+		td.Add(float64(i))
+	}
+
+	cases := []struct {
+		q    float64
+		want float64
+		tol  float64
+	}{
+		{0.5, 500, 15},
+		{0.95, 950, 20},
+		{0.99, 990, 15},
+	}
+	for _, c := range cases {
+		got := td.Quantile(c.q)
+		if math.Abs(got-c.want) > c.tol {
+			t.Errorf("Quantile(%v) = %v, want within %v of %v", c.q, got, c.tol, c.want)
+		}
+	}
+}
+
+func TestTDigestQuantileEmpty(t *testing.T) {
+	td := newTDigest()
+	if got := td.Quantile(0.5); got != 0 {
+		t.Errorf("Quantile on empty digest = %v, want 0", got)
+	}
+	if got := td.Max(); got != 0 {
+		t.Errorf("Max on empty digest = %v, want 0", got)
+	}
+}
+
+func TestTDigestQuantileSingleValue(t *testing.T) {
+	td := newTDigest()
+	td.Add(42)
+	if got := td.Quantile(0.5); got != 42 {
+		t.Errorf("Quantile(0.5) = %v, want 42", got)
+	}
+	if got := td.Max(); got != 42 {
+		t.Errorf("Max() = %v, want 42", got)
+	}
+}
+
+func TestTDigestMax(t *testing.T) {
+	td := newTDigest()
+	for _, v := range []float64{5, 1, 900, 42, 3} {
+		td.Add(v)
+	}
+	if got := td.Max(); got != 900 {
+		t.Errorf("Max() = %v, want 900", got)
+	}
+}
+
+// TestTDigestMergeMatchesSingle checks that merging two independently-built
+// digests (as scrapeAll does across shards/databases) gives quantile
+// estimates close to building one digest from the combined samples, since
+// that equivalence is what lets results be aggregated per-target instead of
+// needing every raw millis value funneled through one digest.
+func TestTDigestMergeMatchesSingle(t *testing.T) {
+	combined := newTDigest()
+	a := newTDigest()
+	b := newTDigest()
+	for i := 1; i <= 500; i++ {
+		combined.Add(float64(i))
+		a.Add(float64(i))
+	}
+	for i := 501; i <= 1000; i++ {
+		combined.Add(float64(i))
+		b.Add(float64(i))
+	}
+
+	merged := newTDigest()
+	merged.Merge(a)
+	merged.Merge(b)
+
+	for _, q := range []float64{0.5, 0.95, 0.99} {
+		want := combined.Quantile(q)
+		got := merged.Quantile(q)
+		if math.Abs(got-want) > 25 {
+			t.Errorf("merged Quantile(%v) = %v, want within 25 of %v", q, got, want)
+		}
+	}
+}